@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tg123/go-htpasswd"
+)
+
+const authRealm = "wshacker"
+
+// Auth gates the MITM listeners. Validate reports whether r carries valid
+// proxy credentials; it may also set headers on w but must not write a
+// final status - the caller sends 407 on a false return.
+type Auth interface {
+	Validate(w http.ResponseWriter, r *http.Request) bool
+}
+
+// noneAuth lets every request through, the default when -auth is unset.
+type noneAuth struct{}
+
+func (noneAuth) Validate(w http.ResponseWriter, r *http.Request) bool { return true }
+
+// staticAuth checks a single fixed username/password pair.
+type staticAuth struct {
+	user string
+	pass string
+}
+
+func (a *staticAuth) Validate(w http.ResponseWriter, r *http.Request) bool {
+	user, pass, ok := proxyBasicAuth(r)
+	if !ok {
+		return false
+	}
+	// constant-time to avoid a timing side channel on the configured password
+	userOk := subtle.ConstantTimeCompare([]byte(user), []byte(a.user)) == 1
+	passOk := subtle.ConstantTimeCompare([]byte(pass), []byte(a.pass)) == 1
+	return userOk && passOk
+}
+
+// basicFileAuth checks credentials against an Apache-style htpasswd file,
+// reloading it whenever its mtime changes.
+type basicFileAuth struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	file    *htpasswd.File
+}
+
+func newBasicFileAuth(path string) (*basicFileAuth, error) {
+	a := &basicFileAuth{path: path}
+	if err := a.reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *basicFileAuth) reload() error {
+	fi, err := os.Stat(a.path)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file != nil && fi.ModTime().Equal(a.modTime) {
+		return nil
+	}
+
+	file, err := htpasswd.New(a.path, htpasswd.DefaultSystems, func(err error) {
+		log.Println("auth: bad line in", a.path, ":", err)
+	})
+	if err != nil {
+		return err
+	}
+
+	a.file = file
+	a.modTime = fi.ModTime()
+	return nil
+}
+
+func (a *basicFileAuth) Validate(w http.ResponseWriter, r *http.Request) bool {
+	if err := a.reload(); err != nil {
+		log.Println("auth: reload", a.path, "failed:", err)
+	}
+
+	user, pass, ok := proxyBasicAuth(r)
+	if !ok {
+		return false
+	}
+
+	a.mu.Lock()
+	file := a.file
+	a.mu.Unlock()
+
+	return file.Match(user, pass)
+}
+
+// proxyBasicAuth reads Basic credentials from Proxy-Authorization, the
+// header a client sends for an intercepting proxy (as opposed to
+// Authorization, which net/http's Request.BasicAuth reads).
+func proxyBasicAuth(r *http.Request) (user, pass string, ok bool) {
+	const prefix = "Basic "
+	h := r.Header.Get("Proxy-Authorization")
+	if !strings.HasPrefix(h, prefix) {
+		return "", "", false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(h[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+
+	cred := string(decoded)
+	i := strings.IndexByte(cred, ':')
+	if i < 0 {
+		return "", "", false
+	}
+	return cred[:i], cred[i+1:], true
+}
+
+// newAuth builds an Auth from an -auth flag value: "", "none", "static:user:pass"
+// or "basicfile:/path/to/htpasswd".
+func newAuth(spec string) (Auth, error) {
+	if spec == "" || spec == "none" {
+		return noneAuth{}, nil
+	}
+
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("newauth: invalid -auth value %q, want scheme:rest", spec)
+	}
+	scheme, rest := parts[0], parts[1]
+
+	switch scheme {
+	case "static":
+		userPass := strings.SplitN(rest, ":", 2)
+		if len(userPass) != 2 {
+			return nil, fmt.Errorf("newauth: static auth wants user:pass, got %q", rest)
+		}
+		return &staticAuth{user: userPass[0], pass: userPass[1]}, nil
+	case "basicfile":
+		return newBasicFileAuth(rest)
+	default:
+		return nil, fmt.Errorf("newauth: unknown auth scheme %q", scheme)
+	}
+}
+
+// requireAuth sends the 407 that tells the client to (re)supply Basic
+// credentials for realm authRealm.
+func requireAuth(w http.ResponseWriter) {
+	w.Header().Set("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q", authRealm))
+	http.Error(w, "Proxy Authentication Required", http.StatusProxyAuthRequired)
+}
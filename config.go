@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/BurntSushi/toml"
+)
+
+// config mirrors the -config TOML file. CLI flags always take precedence
+// over whatever is set here; see mergeConfig in server.go.
+type config struct {
+	Listen    listenConfig    `toml:"listen"`
+	TLS       tlsConfigFile   `toml:"tls"`
+	DNS       dnsConfig       `toml:"dns"`
+	Auth      authConfig      `toml:"auth"`
+	WebSocket webSocketConfig `toml:"websocket"`
+}
+
+type listenConfig struct {
+	HTTP  string   `toml:"http"`
+	HTTPS string   `toml:"https"`
+	Extra []string `toml:"extra"` // additional plain HTTP listeners
+}
+
+type tlsConfigFile struct {
+	Certs      string `toml:"certs"`
+	MinVersion string `toml:"min_version"`
+	MaxVersion string `toml:"max_version"`
+	Ciphers    string `toml:"ciphers"`
+	Curves     string `toml:"curves"`
+}
+
+type dnsConfig struct {
+	Upstreams []string `toml:"upstreams"`
+	Bootstrap string   `toml:"bootstrap"`
+	Hack6     string   `toml:"hack6"`
+	// Hijack lists the hostnames to answer with the MITM address, the same
+	// "*.example.com" prefix syntax as the flat hosts file wsServer.parseDNS
+	// reads, just inlined here instead of a separate file.
+	Hijack []string `toml:"hijack"`
+}
+
+type authConfig struct {
+	Mode         string `toml:"mode"`
+	HiddenDomain string `toml:"hidden_domain"`
+}
+
+type webSocketConfig struct {
+	ReadBufferSize  int      `toml:"read_buffer_size"`
+	WriteBufferSize int      `toml:"write_buffer_size"`
+	Compression     *bool    `toml:"compression"` // nil means "not set in the file"
+	Subprotocols    []string `toml:"subprotocols"`
+}
+
+// loadConfig decodes a wshacker TOML config file, naming the file in any
+// error so a bad key is easy to trace back to its source.
+func loadConfig(path string) (*config, error) {
+	var cfg config
+	if _, err := toml.DecodeFile(path, &cfg); err != nil {
+		return nil, fmt.Errorf("config: %s: %w", path, err)
+	}
+	return &cfg, nil
+}
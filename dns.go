@@ -1,29 +1,39 @@
 package main
 
 import (
-	"bytes"
 	"container/heap"
 	"encoding/binary"
+	"fmt"
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
-)
 
-var (
-	Answer = []byte("\x00\x01\x00\x01\xff\xff\xff\xff\x00\x04\x7f\x00\x00\x01")
+	"github.com/miekg/dns"
 )
 
+const dnsHackTTL uint32 = 300
+
 type dnsReverser interface {
-	isReverse(host string) bool
+	isReverse(host string, qtype uint16) bool
 }
 
 type DnsProxy struct {
 	dnsHack     string
+	dnsHack6    string
 	udpListen   *net.UDPConn
-	udpUpstream *net.UDPConn
+	udpUpstream *net.UDPConn // only set when upstreams[0] is plain UDP, see newDnsProxy
 	serverAddr  *net.UDPAddr
 
+	// upstreams is the full round-robin pool. If upstreams[0] is plain UDP it is
+	// also served by udpUpstream/serverAddr and the pending-request heap below,
+	// the optimized path inherited from the original single-upstream proxy.
+	// Every other upstream (DoT/DoH/extra UDP/TCP servers) is exchanged with
+	// synchronously in its own goroutine, short-circuiting the heap entirely.
+	upstreams []Upstream
+	next      uint32
+
 	entries  []entry
 	indices  map[int]int
 	mu       sync.Mutex
@@ -121,13 +131,13 @@ func (h *DnsProxy) updateTask() {
 	}
 }
 
-func runDns(listenAddr string, dnsServer string, dnsr dnsReverser) {
+func runDns(listenAddr string, dnsHack6 string, dnsServers []string, bootstrap string, dnsr dnsReverser) {
 	saddr, err := net.ResolveUDPAddr("udp", listenAddr+":53")
 	if err != nil {
 		log.Fatal(err)
 		return
 	}
-	log.Println("dnsHack", listenAddr, "dnsServer", dnsServer)
+	log.Println("dnsHack", listenAddr, "dnsHack6", dnsHack6, "dnsServers", dnsServers)
 
 	udpListen, err := net.ListenUDP("udp", saddr)
 	if err != nil {
@@ -136,130 +146,199 @@ func runDns(listenAddr string, dnsServer string, dnsr dnsReverser) {
 	}
 	defer udpListen.Close()
 
-	dns, err := newDnsProxy(listenAddr, udpListen, dnsServer, dnsr)
+	proxy, err := newDnsProxy(listenAddr, dnsHack6, udpListen, dnsServers, bootstrap, dnsr)
 	if err != nil {
 		log.Fatal(err)
 		return
 	}
-	defer dns.udpUpstream.Close()
-
-	go dns.updateTask()
 
-	go func() {
-		for {
-			if err := dns.processUpstream(); err != nil {
-				break
+	if proxy.udpUpstream != nil {
+		defer proxy.udpUpstream.Close()
+		go func() {
+			for {
+				if err := proxy.processUpstream(); err != nil {
+					break
+				}
 			}
-		}
-	}()
+		}()
+	}
+
+	go proxy.updateTask()
 
 	for {
-		if err := dns.handleUDP(); err != nil {
+		if err := proxy.handleUDP(); err != nil {
 			return
 		}
 	}
 }
 
-func newDnsProxy(dnsHack string, udpListen *net.UDPConn, dnsServer string, dnsr dnsReverser) (*DnsProxy, error) {
-	udpUpstream, err := net.ListenUDP("udp", &net.UDPAddr{})
-	if err != nil {
-		return nil, err
-	}
-	serverAddr, err := net.ResolveUDPAddr("udp", dnsServer)
-	if err != nil {
-		return nil, err
+func newDnsProxy(dnsHack string, dnsHack6 string, udpListen *net.UDPConn, dnsServers []string, bootstrap string, dnsr dnsReverser) (*DnsProxy, error) {
+	if len(dnsServers) == 0 {
+		return nil, fmt.Errorf("newdnsproxy: no upstream dns servers configured")
 	}
 
-	return &DnsProxy{
-		dnsHack:     dnsHack,
-		udpListen:   udpListen,
-		udpUpstream: udpUpstream,
-		serverAddr:  serverAddr,
+	p := &DnsProxy{
+		dnsHack:   dnsHack,
+		dnsHack6:  dnsHack6,
+		udpListen: udpListen,
 
 		entries:  make([]entry, 0),
 		indices:  make(map[int]int),
 		chWakeUp: make(chan struct{}, 1),
 		reverser: dnsr,
-	}, nil
+	}
+
+	for _, addr := range dnsServers {
+		up, err := AddressToUpstream(addr, bootstrap)
+		if err != nil {
+			return nil, err
+		}
+		p.upstreams = append(p.upstreams, up)
+	}
+
+	if du, ok := p.upstreams[0].(*dnsClientUpstream); ok && du.client.Net == "udp" {
+		udpUpstream, err := net.ListenUDP("udp", &net.UDPAddr{})
+		if err != nil {
+			return nil, err
+		}
+		serverAddr, err := net.ResolveUDPAddr("udp", du.addr)
+		if err != nil {
+			return nil, err
+		}
+		p.udpUpstream = udpUpstream
+		p.serverAddr = serverAddr
+	}
+
+	return p, nil
 }
 
-func (dns *DnsProxy) handleUDP() error {
+// nextUpstream picks the next upstream to use in round-robin order.
+func (p *DnsProxy) nextUpstream() Upstream {
+	n := atomic.AddUint32(&p.next, 1)
+	return p.upstreams[int(n)%len(p.upstreams)]
+}
+
+func (p *DnsProxy) handleUDP() error {
 	buf := make([]byte, 4096)
-	n, addr, err := dns.udpListen.ReadFromUDP(buf)
+	n, addr, err := p.udpListen.ReadFromUDP(buf)
 	if err != nil {
 		return err
 	}
 	buf = buf[:n]
 
-	queryId := int(binary.BigEndian.Uint16(buf[0:2]))
-	host := dns.hostFromMsg(buf)
+	msg := new(dns.Msg)
+	if err := msg.Unpack(buf); err != nil {
+		log.Println("dns unpack failed:", err)
+		return nil
+	}
 
-	isReverse := dns.reverser.isReverse(host)
-	if isReverse {
-		log.Println("dns query:", host, "hack it to:", dns.dnsHack)
-		dns.hackDns(buf, host, dns.dnsHack, addr)
-	} else {
-		log.Println("dns query:", host)
+	if len(msg.Question) != 1 {
+		// can't decide a single host to match against, always delegate
+		return p.forwardUpstream(buf, msg, addr)
+	}
+
+	q := msg.Question[0]
+	if p.reverser.isReverse(q.Name, q.Qtype) {
+		log.Println("dns query:", q.Name, "hack it to:", p.dnsHack)
+		p.hackDns(msg, addr)
+		return nil
+	}
+
+	log.Println("dns query:", q.Name)
+	return p.forwardUpstream(buf, msg, addr)
+}
+
+// forwardUpstream sends msg to the next upstream in round-robin order. The
+// plain UDP upstream at upstreams[0], if configured, reuses the original
+// shared-socket/pending-heap fast path; every other upstream is exchanged
+// with synchronously in its own goroutine, short-circuiting the wait.
+func (p *DnsProxy) forwardUpstream(raw []byte, msg *dns.Msg, addr *net.UDPAddr) error {
+	up := p.nextUpstream()
+	if p.udpUpstream != nil && up == p.upstreams[0] {
 		q := &DnsQuery{
-			sid:  queryId,
+			sid:  int(msg.Id),
 			addr: addr,
-			host: host,
 		}
-		dns.addQuery(q)
+		p.addQuery(q)
 
-		if _, err := dns.udpUpstream.WriteToUDP(buf, dns.serverAddr); err != nil {
-			return err
-		}
+		_, err := p.udpUpstream.WriteToUDP(raw, p.serverAddr)
+		return err
 	}
 
+	go p.exchangeAndReply(up, msg, addr)
 	return nil
 }
 
-func (dns *DnsProxy) hostFromMsg(msg []byte) string {
-	var domain bytes.Buffer
-	var host string
+func (p *DnsProxy) exchangeAndReply(up Upstream, msg *dns.Msg, addr *net.UDPAddr) {
+	resp, err := up.Exchange(msg)
+	if err != nil {
+		log.Println("dns upstream", up, "exchange failed:", err)
+		return
+	}
 
-	count := uint8(msg[5]) // question counter
-	offset := 12           // point to first domain name
-	if count == 1 {
-		for {
-			length := int8(msg[offset])
-			if length == 0 {
-				break
+	out, err := resp.Pack()
+	if err != nil {
+		log.Println("dns pack failed:", err)
+		return
+	}
+	p.udpListen.WriteTo(out, addr)
+}
+
+// hackDns builds a forged response for the query carried by msg, preserving
+// its id/flags/question section, and writes it straight back to addr.
+func (p *DnsProxy) hackDns(msg *dns.Msg, addr *net.UDPAddr) {
+	resp := new(dns.Msg)
+	resp.SetReply(msg)
+	resp.Authoritative = true
+	resp.RecursionAvailable = true
+	resp.Compress = true
+
+	q := msg.Question[0]
+	switch q.Qtype {
+	case dns.TypeA:
+		if ip := net.ParseIP(p.dnsHack).To4(); ip != nil {
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: dnsHackTTL},
+				A:   ip,
+			})
+		}
+	case dns.TypeAAAA:
+		if p.dnsHack6 != "" {
+			if ip := net.ParseIP(p.dnsHack6).To16(); ip != nil {
+				resp.Answer = append(resp.Answer, &dns.AAAA{
+					Hdr:  dns.RR_Header{Name: q.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: dnsHackTTL},
+					AAAA: ip,
+				})
 			}
-			offset++
-			domain.WriteString(string(msg[offset : offset+int(length)]))
-			domain.WriteString(".")
-			offset += int(length)
 		}
-
-		host = domain.String()
-		return host
+		// no dnsHack6 configured: answer NOERROR/NODATA rather than forging a lie
+	default:
+		// unreachable in practice: dnsReverser.isReverse only matches A/AAAA
+		// queries, so any other qtype is delegated upstream before reaching
+		// hackDns at all.
 	}
-	return ""
-}
 
-func (dns *DnsProxy) hackDns(msg []byte, host string, target string, addr *net.UDPAddr) {
-	targetIp := net.ParseIP(target)
-	msg[2] = uint8(129)                           // flags upper byte
-	msg[3] = uint8(128)                           // flags lower byte
-	msg[7] = uint8(1)                             // answer counter
-	msg = append(msg, msg[12:12+1+len(host)]...)  // domain
-	msg = append(msg, Answer[0:len(Answer)-4]...) // payload
-	msg = append(msg, []byte(targetIp.To4())...)
+	if opt := msg.IsEdns0(); opt != nil {
+		resp.Extra = append(resp.Extra, opt)
+	}
 
-	dns.udpListen.WriteTo(msg, addr)
+	out, err := resp.Pack()
+	if err != nil {
+		log.Println("dns pack failed:", err)
+		return
+	}
+	p.udpListen.WriteTo(out, addr)
 }
 
-func (dns *DnsProxy) processUpstream() error {
+func (p *DnsProxy) processUpstream() error {
 	buf := make([]byte, 4096)
-	n, _, err := dns.udpUpstream.ReadFromUDP(buf)
+	n, _, err := p.udpUpstream.ReadFromUDP(buf)
 	if err == nil {
 		buf = buf[:n]
 		queryId := int(binary.BigEndian.Uint16(buf[0:2]))
-		q := dns.removeQuery(queryId)
+		q := p.removeQuery(queryId)
 		if q != nil {
-			dns.udpListen.WriteTo(buf, q.addr)
+			p.udpListen.WriteTo(buf, q.addr)
 		}
 		return nil
 	} else {
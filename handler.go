@@ -12,13 +12,20 @@ import (
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/miekg/dns"
 )
 
 type wsServer struct {
 	reversePrefix map[string]int
 	reverseUrlMap map[string]int
-	rt            *http.Transport
+	rt            http.RoundTripper
 	upgrader      *websocket.Upgrader
+
+	auth Auth
+	// hiddenAuthDomain, when requested directly, always answers 407 to make
+	// the browser drop its cached Basic credentials for our realm and
+	// re-prompt, the same trick dumbproxy uses for forcing reauth.
+	hiddenAuthDomain string
 }
 
 type wsHandler struct {
@@ -60,6 +67,16 @@ func (h *wsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	log.Println("URL", r.URL, "RemoteAddr", r.RemoteAddr)
 
+	if h.s.hiddenAuthDomain != "" && r.URL.Hostname() == h.s.hiddenAuthDomain {
+		requireAuth(w)
+		return
+	}
+	if !h.s.auth.Validate(w, r) {
+		requireAuth(w)
+		return
+	}
+	r.Header.Del("Proxy-Authorization")
+
 	if r.Header.Get("Upgrade") == "websocket" {
 		err := h.s.serveWebSocket(w, r)
 		if err != nil {
@@ -76,7 +93,11 @@ func (h *wsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	defer resp.Body.Close()
 	copyResponseHeader(w, resp)
-	if resp.ContentLength > 0 {
+	if resp.ProtoMajor >= 2 || len(resp.Trailer) > 0 {
+		// h2/h3 responses are framed natively by the server and don't need a
+		// Content-Length/chunked Transfer-Encoding rewritten on top; forcing
+		// one here would also break streaming and any trailers.
+	} else if resp.ContentLength > 0 {
 		w.Header().Set("Content-Length", strconv.Itoa(int(resp.ContentLength)))
 	} else {
 		w.Header().Set("Transfer-Encoding", "chunked")
@@ -195,19 +216,32 @@ func (s *wsServer) parseDNS(hosts string) error {
 	defer file.Close()
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
-		dns := scanner.Text()
-		if len(dns) > 2 {
-			if dns[0:2] == "*." {
-				s.reversePrefix[dns[2:len(dns)]] = 1
-			} else {
-				s.reverseUrlMap[dns] = 1
-			}
-		}
+		s.addHijackRule(scanner.Text())
 	}
 	return nil
 }
 
-func (s *wsServer) isReverse(host string) bool {
+// addHijackRule adds one hostname to hijack, in the "*.example.com" prefix
+// or exact "example.com" syntax used by both the hosts file and the
+// [dns].hijack list in a -config TOML file.
+func (s *wsServer) addHijackRule(rule string) {
+	if len(rule) <= 2 {
+		return
+	}
+	if rule[0:2] == "*." {
+		s.reversePrefix[rule[2:len(rule)]] = 1
+	} else {
+		s.reverseUrlMap[rule] = 1
+	}
+}
+
+// isReverse reports whether host is a hijacked host and qtype is one hackDns
+// can actually forge a MITM answer for (A/AAAA); any other qtype is delegated
+// upstream instead of getting a blanket NODATA.
+func (s *wsServer) isReverse(host string, qtype uint16) bool {
+	if qtype != dns.TypeA && qtype != dns.TypeAAAA {
+		return false
+	}
 	if len(host) > 0 && host[len(host)-1] == '.' {
 		host = host[0 : len(host)-1]
 	}
@@ -7,10 +7,13 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"os"
 	"path/filepath"
 	"strings"
 
 	"github.com/gorilla/websocket"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
 )
 
 func getOutboundIP(s string) (net.IP, error) {
@@ -25,15 +28,161 @@ func getOutboundIP(s string) (net.IP, error) {
 	return localAddr.IP, nil
 }
 
+// dialHint strips a dnsServers entry down to a bare host:port suitable for
+// net.Dial, regardless of whether it was a plain address or a
+// scheme://host[/path] upstream URL.
+func dialHint(addr string) string {
+	if i := strings.Index(addr, "://"); i >= 0 {
+		addr = addr[i+3:]
+	}
+	if i := strings.IndexByte(addr, '/'); i >= 0 {
+		addr = addr[:i]
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "53")
+	}
+	return addr
+}
+
+// dnsServersFlag collects repeated -dns flags into an ordered list of
+// upstream addresses.
+type dnsServersFlag []string
+
+func (f *dnsServersFlag) String() string { return strings.Join(*f, ",") }
+func (f *dnsServersFlag) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
+
+// settings holds every value that can come from either a CLI flag or the
+// -config TOML file, so mergeConfig has somewhere to apply the file's values
+// without reaching back into main's locals.
+type settings struct {
+	certs, httpAddr, https, dnsHack6, bootstrap, auth, authHiddenDomain string
+	tlsMinVersion, tlsMaxVersion, tlsCiphers, tlsCurves                 string
+	dnsServers                                                         dnsServersFlag
+	extraListeners, dnsHijack                                          []string
+
+	wsReadBufferSize, wsWriteBufferSize int
+	wsCompression                       bool
+	wsSubprotocols                      []string
+}
+
+// mergeConfig applies cfg on top of s, skipping any field whose matching CLI
+// flag was explicitly passed on the command line: CLI flags always take
+// precedence over whatever is set in the file.
+func mergeConfig(s *settings, cfg *config) {
+	visited := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { visited[f.Name] = true })
+	override := func(name string, dst *string, val string) {
+		if val != "" && !visited[name] {
+			*dst = val
+		}
+	}
+
+	override("http", &s.httpAddr, cfg.Listen.HTTP)
+	override("https", &s.https, cfg.Listen.HTTPS)
+	s.extraListeners = cfg.Listen.Extra
+
+	override("certs", &s.certs, cfg.TLS.Certs)
+	override("tls-min-version", &s.tlsMinVersion, cfg.TLS.MinVersion)
+	override("tls-max-version", &s.tlsMaxVersion, cfg.TLS.MaxVersion)
+	override("tls-ciphers", &s.tlsCiphers, cfg.TLS.Ciphers)
+	override("tls-curves", &s.tlsCurves, cfg.TLS.Curves)
+
+	if !visited["dns"] && len(cfg.DNS.Upstreams) > 0 {
+		s.dnsServers = dnsServersFlag(cfg.DNS.Upstreams)
+	}
+	override("bootstrap", &s.bootstrap, cfg.DNS.Bootstrap)
+	override("dns6", &s.dnsHack6, cfg.DNS.Hack6)
+	s.dnsHijack = cfg.DNS.Hijack
+
+	override("auth", &s.auth, cfg.Auth.Mode)
+	override("auth-hidden-domain", &s.authHiddenDomain, cfg.Auth.HiddenDomain)
+
+	if cfg.WebSocket.ReadBufferSize > 0 {
+		s.wsReadBufferSize = cfg.WebSocket.ReadBufferSize
+	}
+	if cfg.WebSocket.WriteBufferSize > 0 {
+		s.wsWriteBufferSize = cfg.WebSocket.WriteBufferSize
+	}
+	if len(cfg.WebSocket.Subprotocols) > 0 {
+		s.wsSubprotocols = cfg.WebSocket.Subprotocols
+	}
+	if cfg.WebSocket.Compression != nil {
+		s.wsCompression = *cfg.WebSocket.Compression
+	}
+}
+
 func main() {
-	var certs, httpAddr, https, hosts, dnsServer string
+	var certs, httpAddr, https, hosts, dnsHack6, bootstrap, auth, authHiddenDomain, configPath string
+	var tlsMinVersion, tlsMaxVersion, tlsCiphers, tlsCurves string
+	var dnsServers dnsServersFlag
+	var h3, listCiphersFlag bool
 	flag.StringVar(&certs, "certs", "certs", "certs path")
 	flag.StringVar(&httpAddr, "http", ":80", "http addr")
 	flag.StringVar(&https, "https", ":443", "https addr")
-	flag.StringVar(&dnsServer, "dns", "10.1.150.1:53", "dns server addr")
+	flag.Var(&dnsServers, "dns", "upstream dns server, may be repeated; udp://host:port (default), tcp://host:port, tls://host:port (DoT), https://host/path (DoH)")
 	flag.StringVar(&hosts, "hosts", "hosts", "hosts file to reverse dns")
+	flag.StringVar(&dnsHack6, "dns6", "", "AAAA hijack target, empty answers NODATA")
+	flag.StringVar(&bootstrap, "bootstrap", "", "plain host:port resolver used to look up DoH/DoT hostnames")
+	flag.BoolVar(&h3, "h3", false, "experimental: also reach origins over HTTP/3 and serve the https listener over QUIC")
+	flag.StringVar(&auth, "auth", "none", "proxy auth: none, static:user:pass, basicfile:/path/to/htpasswd")
+	flag.StringVar(&authHiddenDomain, "auth-hidden-domain", "", "hostname that always 407s, used to force a browser to re-prompt for credentials")
+	flag.StringVar(&tlsMinVersion, "tls-min-version", "", "minimum tls version offered/dialed, one of 1.0 1.1 1.2 1.3")
+	flag.StringVar(&tlsMaxVersion, "tls-max-version", "", "maximum tls version offered/dialed, one of 1.0 1.1 1.2 1.3")
+	flag.StringVar(&tlsCiphers, "tls-ciphers", "", "comma-separated cipher suite names, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256")
+	flag.StringVar(&tlsCurves, "tls-curves", "", "comma-separated curve preferences, e.g. X25519,P-256")
+	flag.BoolVar(&listCiphersFlag, "list-ciphers", false, "print supported cipher suites (name, IANA id, tls versions, insecure) and exit")
+	flag.StringVar(&configPath, "config", "", "path to a wshacker.toml config file; CLI flags override its values")
 	flag.Parse()
 
+	if listCiphersFlag {
+		listCiphers()
+		os.Exit(0)
+	}
+
+	cfgSettings := &settings{
+		certs: certs, httpAddr: httpAddr, https: https,
+		dnsHack6: dnsHack6, bootstrap: bootstrap,
+		auth: auth, authHiddenDomain: authHiddenDomain,
+		tlsMinVersion: tlsMinVersion, tlsMaxVersion: tlsMaxVersion,
+		tlsCiphers: tlsCiphers, tlsCurves: tlsCurves,
+		dnsServers: dnsServers,
+
+		wsReadBufferSize:  16384,
+		wsWriteBufferSize: 16384,
+		wsCompression:     true,
+		wsSubprotocols:    []string{"zuolin"},
+	}
+
+	if configPath != "" {
+		cfg, err := loadConfig(configPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		mergeConfig(cfgSettings, cfg)
+	}
+
+	certs, httpAddr, https = cfgSettings.certs, cfgSettings.httpAddr, cfgSettings.https
+	dnsHack6, bootstrap = cfgSettings.dnsHack6, cfgSettings.bootstrap
+	auth, authHiddenDomain = cfgSettings.auth, cfgSettings.authHiddenDomain
+	tlsMinVersion, tlsMaxVersion = cfgSettings.tlsMinVersion, cfgSettings.tlsMaxVersion
+	tlsCiphers, tlsCurves = cfgSettings.tlsCiphers, cfgSettings.tlsCurves
+	dnsServers = cfgSettings.dnsServers
+	extraListeners, dnsHijack := cfgSettings.extraListeners, cfgSettings.dnsHijack
+	wsReadBufferSize, wsWriteBufferSize := cfgSettings.wsReadBufferSize, cfgSettings.wsWriteBufferSize
+	wsCompression, wsSubprotocols := cfgSettings.wsCompression, cfgSettings.wsSubprotocols
+
+	if len(dnsServers) == 0 {
+		dnsServers = dnsServersFlag{"10.1.150.1:53"}
+	}
+
+	profile, err := newTLSProfile(tlsMinVersion, tlsMaxVersion, tlsCiphers, tlsCurves)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	tlsConfig := &tls.Config{}
 	tlsConfig.Certificates = make([]tls.Certificate, 0)
 	files, err := ioutil.ReadDir(certs)
@@ -66,16 +215,32 @@ func main() {
 	}
 
 	tlsConfig.BuildNameToCertificate()
+	tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+	profile.apply(tlsConfig)
+
+	clientTLSConfig := &tls.Config{}
+	profile.apply(clientTLSConfig)
+	rt, err := newRoundTripper(clientTLSConfig, h3)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	authenticator, err := newAuth(auth)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	s := &wsServer{
-		reverseUrlMap: make(map[string]int),
-		reversePrefix: make(map[string]int),
-		rt:            &http.Transport{},
+		reverseUrlMap:    make(map[string]int),
+		reversePrefix:    make(map[string]int),
+		rt:               rt,
+		auth:             authenticator,
+		hiddenAuthDomain: authHiddenDomain,
 		upgrader: &websocket.Upgrader{
-			ReadBufferSize:    16384,
-			WriteBufferSize:   16384,
-			EnableCompression: true,
-			Subprotocols:      []string{"zuolin"},
+			ReadBufferSize:    wsReadBufferSize,
+			WriteBufferSize:   wsWriteBufferSize,
+			EnableCompression: wsCompression,
+			Subprotocols:      wsSubprotocols,
 			CheckOrigin: func(r *http.Request) bool {
 				return true
 			},
@@ -85,17 +250,22 @@ func main() {
 		},
 	}
 
-	err = s.parseDNS(hosts)
-	if err != nil {
-		panic(err)
+	if err := s.parseDNS(hosts); err != nil {
+		if len(dnsHijack) == 0 {
+			panic(err)
+		}
+		log.Println("hosts file", hosts, "not used:", err)
+	}
+	for _, rule := range dnsHijack {
+		s.addHijackRule(rule)
 	}
 
-	localIP, err := getOutboundIP(dnsServer)
+	localIP, err := getOutboundIP(dialHint(dnsServers[0]))
 	if err != nil {
 		panic(err)
 	}
 	log.Println("got localIP", localIP)
-	go runDns(localIP.String(), dnsServer, s)
+	go runDns(localIP.String(), dnsHack6, []string(dnsServers), bootstrap, s)
 
 	lhttp, err := net.Listen("tcp", httpAddr)
 	if err != nil {
@@ -107,13 +277,40 @@ func main() {
 	}
 	go httpServer.Serve(lhttp)
 
+	for _, extraAddr := range extraListeners {
+		l, err := net.Listen("tcp", extraAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println("run extra http listener ok", extraAddr)
+		go (&http.Server{Handler: &wsHandler{false, s}}).Serve(l)
+	}
+
+	httpsServer := &http.Server{
+		Handler: &wsHandler{true, s},
+	}
+	if err := http2.ConfigureServer(httpsServer, &http2.Server{}); err != nil {
+		log.Fatal(err)
+	}
+
+	if h3 {
+		h3Server := &http3.Server{
+			Addr:      https,
+			TLSConfig: tlsConfig,
+			Handler:   httpsServer.Handler,
+		}
+		go func() {
+			log.Println("run http3 ok", https)
+			if err := h3Server.ListenAndServe(); err != nil {
+				log.Println("http3 server stopped:", err)
+			}
+		}()
+	}
+
 	lhttps, err := tls.Listen("tcp", https, tlsConfig)
 	if err != nil {
 		log.Fatal(err)
 	}
 	log.Println("run https ok", https)
-	httpsServer := &http.Server{
-		Handler: &wsHandler{true, s},
-	}
 	httpsServer.Serve(lhttps)
 }
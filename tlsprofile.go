@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+var tlsVersionsByName = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func tlsVersionFromName(name string) (uint16, error) {
+	v, ok := tlsVersionsByName[name]
+	if !ok {
+		return 0, fmt.Errorf("tlsversionfromname: unknown tls version %q, want one of 1.0, 1.1, 1.2, 1.3", name)
+	}
+	return v, nil
+}
+
+func tlsVersionName(v uint16) string {
+	for name, id := range tlsVersionsByName {
+		if id == v {
+			return name
+		}
+	}
+	return fmt.Sprintf("0x%04x", v)
+}
+
+var tlsCurvesByName = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P-256":  tls.CurveP256,
+	"P-384":  tls.CurveP384,
+	"P-521":  tls.CurveP521,
+}
+
+// cipherSuitesFromNames resolves a comma-separated list of suite names
+// (e.g. "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256") against everything
+// crypto/tls knows about, secure and insecure alike. An empty names string
+// leaves the returned slice nil, meaning "use Go's default policy".
+func cipherSuitesFromNames(names string) ([]uint16, error) {
+	if names == "" {
+		return nil, nil
+	}
+
+	byName := make(map[string]uint16)
+	for _, c := range allCipherSuites() {
+		byName[c.Name] = c.ID
+	}
+
+	var ids []uint16
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		id, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("ciphersuitesfromnames: unknown cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// curvesFromNames resolves a comma-separated list of curve names (e.g.
+// "X25519,P-256") into their crypto/tls IDs.
+func curvesFromNames(names string) ([]tls.CurveID, error) {
+	if names == "" {
+		return nil, nil
+	}
+
+	var curves []tls.CurveID
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		id, ok := tlsCurvesByName[name]
+		if !ok {
+			return nil, fmt.Errorf("curvesfromnames: unknown curve %q", name)
+		}
+		curves = append(curves, id)
+	}
+	return curves, nil
+}
+
+func allCipherSuites() []*tls.CipherSuite {
+	return append(tls.CipherSuites(), tls.InsecureCipherSuites()...)
+}
+
+func isInsecureCipherSuite(id uint16) bool {
+	for _, c := range tls.InsecureCipherSuites() {
+		if c.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// listCiphers prints every cipher suite crypto/tls knows about with its IANA
+// ID, the TLS versions it applies to and whether Go marks it insecure, for
+// the -list-ciphers flag.
+func listCiphers() {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tID\tVERSIONS\tINSECURE")
+	for _, c := range allCipherSuites() {
+		versions := make([]string, 0, len(c.SupportedVersions))
+		for _, v := range c.SupportedVersions {
+			versions = append(versions, tlsVersionName(v))
+		}
+		fmt.Fprintf(tw, "%s\t0x%04X\t%s\t%v\n", c.Name, c.ID, strings.Join(versions, ","), isInsecureCipherSuite(c.ID))
+	}
+	tw.Flush()
+}
+
+// tlsProfile is the operator-controlled TLS policy shared by the frontend
+// MITM listener and the outbound transport reaching real origins.
+type tlsProfile struct {
+	minVersion   uint16
+	maxVersion   uint16
+	cipherSuites []uint16
+	curves       []tls.CurveID
+}
+
+func newTLSProfile(minVersion, maxVersion, ciphers, curves string) (*tlsProfile, error) {
+	p := &tlsProfile{}
+
+	var err error
+	if minVersion != "" {
+		if p.minVersion, err = tlsVersionFromName(minVersion); err != nil {
+			return nil, err
+		}
+	}
+	if maxVersion != "" {
+		if p.maxVersion, err = tlsVersionFromName(maxVersion); err != nil {
+			return nil, err
+		}
+	}
+	if p.cipherSuites, err = cipherSuitesFromNames(ciphers); err != nil {
+		return nil, err
+	}
+	if p.curves, err = curvesFromNames(curves); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func (p *tlsProfile) apply(c *tls.Config) {
+	c.MinVersion = p.minVersion
+	c.MaxVersion = p.maxVersion
+	c.CipherSuites = p.cipherSuites
+	c.CurvePreferences = p.curves
+}
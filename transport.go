@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+)
+
+// newRoundTripper builds the outbound RoundTripper used to reach MITM'd
+// origins over their real protocol: HTTP/2 when the origin's ALPN offers it,
+// and, if h3 is true, HTTP/3 first with a fallback to the h2/h1.1 transport
+// when the origin doesn't speak QUIC. tlsClientConfig carries the operator's
+// TLS profile (min/max version, cipher suites, curves) so upstream
+// connections honor the same policy as the frontend listener.
+func newRoundTripper(tlsClientConfig *tls.Config, h3 bool) (http.RoundTripper, error) {
+	base := &http.Transport{
+		ForceAttemptHTTP2: true,
+		TLSClientConfig:   tlsClientConfig,
+	}
+	if err := http2.ConfigureTransport(base); err != nil {
+		return nil, err
+	}
+
+	if !h3 {
+		return base, nil
+	}
+
+	return &h3FallbackTransport{
+		h3:   &http3.RoundTripper{TLSClientConfig: tlsClientConfig},
+		base: base,
+	}, nil
+}
+
+// h3FallbackTransport tries HTTP/3 first and falls back to base (h2/h1.1)
+// when the origin doesn't answer over QUIC, since there's no ALPN-style
+// negotiation to tell upfront whether an origin supports h3.
+type h3FallbackTransport struct {
+	h3   http.RoundTripper
+	base http.RoundTripper
+}
+
+func (t *h3FallbackTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		if resp, err := t.h3.RoundTrip(r); err == nil {
+			return resp, nil
+		}
+		return t.base.RoundTrip(r)
+	}
+
+	// quic-go writes req.Body onto the stream and closes it once that
+	// succeeds, even if RoundTrip later fails with a stream/connection
+	// error. Buffer the body up front so a fallback to base always gets a
+	// fresh, unread copy instead of replaying an already-drained one.
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	h3Req := r.Clone(r.Context())
+	h3Req.Body = io.NopCloser(bytes.NewReader(body))
+	if resp, err := t.h3.RoundTrip(h3Req); err == nil {
+		return resp, nil
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	return t.base.RoundTrip(r)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const upstreamTimeout = 5 * time.Second
+
+const dohMediaType = "application/dns-message"
+
+// Upstream resolves a single DNS query against one upstream server, hiding
+// away whether that happens over plain UDP/TCP, DNS-over-TLS or DNS-over-HTTPS.
+type Upstream interface {
+	Exchange(req *dns.Msg) (*dns.Msg, error)
+	String() string
+}
+
+// dnsClientUpstream covers plain UDP, plain TCP and DoT: miekg/dns already
+// speaks all three through dns.Client's Net field ("udp", "tcp", "tcp-tls").
+type dnsClientUpstream struct {
+	client *dns.Client
+	addr   string
+}
+
+func (u *dnsClientUpstream) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	resp, _, err := u.client.Exchange(req, u.addr)
+	return resp, err
+}
+
+func (u *dnsClientUpstream) String() string {
+	net := u.client.Net
+	if net == "" {
+		net = "udp"
+	}
+	return net + "://" + u.addr
+}
+
+// AddressToUpstream turns an address such as "1.1.1.1:53", "udp://1.1.1.1:53",
+// "tcp://1.1.1.1:53", "tls://1.1.1.1:853" or "https://cloudflare-dns.com/dns-query"
+// into an Upstream. bootstrap, if non-empty, is a plain host:port DNS server
+// used to resolve the hostname of a DoH/DoT upstream without recursing into
+// this same proxy.
+func AddressToUpstream(address string, bootstrap string) (Upstream, error) {
+	if !strings.Contains(address, "://") {
+		return &dnsClientUpstream{
+			client: &dns.Client{Net: "udp", Timeout: upstreamTimeout},
+			addr:   withDefaultPort(address, "53"),
+		}, nil
+	}
+
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("addresstoupstream: %s: %w", address, err)
+	}
+
+	switch u.Scheme {
+	case "udp":
+		return &dnsClientUpstream{
+			client: &dns.Client{Net: "udp", Timeout: upstreamTimeout},
+			addr:   withDefaultPort(u.Host, "53"),
+		}, nil
+	case "tcp":
+		return &dnsClientUpstream{
+			client: &dns.Client{Net: "tcp", Timeout: upstreamTimeout},
+			addr:   withDefaultPort(u.Host, "53"),
+		}, nil
+	case "tls":
+		host := u.Hostname()
+		client := &dns.Client{
+			Net:       "tcp-tls",
+			Timeout:   upstreamTimeout,
+			TLSConfig: &tls.Config{ServerName: host},
+		}
+		if bootstrap != "" {
+			client.Dialer = &net.Dialer{Resolver: bootstrapResolver(bootstrap)}
+		}
+		return &dnsClientUpstream{
+			client: client,
+			addr:   withDefaultPort(u.Host, "853"),
+		}, nil
+	case "https":
+		return newDoHUpstream(u, bootstrap)
+	default:
+		return nil, fmt.Errorf("addresstoupstream: unsupported scheme %q in %s", u.Scheme, address)
+	}
+}
+
+// bootstrapResolver returns a *net.Resolver that always dials bootstrap
+// instead of whatever the OS has configured, so a DoT upstream's hostname
+// resolves without recursing into this same proxy.
+func bootstrapResolver(bootstrap string) *net.Resolver {
+	addr := dialHint(bootstrap)
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+func withDefaultPort(hostport, port string) string {
+	if _, _, err := net.SplitHostPort(hostport); err == nil {
+		return hostport
+	}
+	return net.JoinHostPort(hostport, port)
+}
+
+// dohUpstream speaks DNS-over-HTTPS (RFC 8484): a query is POSTed as the
+// wire-format message with an application/dns-message content type.
+type dohUpstream struct {
+	endpoint string
+	client   *http.Client
+}
+
+func newDoHUpstream(u *url.URL, bootstrap string) (Upstream, error) {
+	transport := &http.Transport{}
+
+	if bootstrap != "" {
+		bootstrapUp, err := AddressToUpstream(bootstrap, "")
+		if err != nil {
+			return nil, fmt.Errorf("doh bootstrap: %w", err)
+		}
+		host := u.Hostname()
+		dialer := &net.Dialer{}
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			h, port, err := net.SplitHostPort(addr)
+			if err == nil && h == host {
+				ip, err := resolveWithUpstream(bootstrapUp, host)
+				if err != nil {
+					return nil, fmt.Errorf("doh bootstrap resolve %s: %w", host, err)
+				}
+				addr = net.JoinHostPort(ip, port)
+			}
+			return dialer.DialContext(ctx, network, addr)
+		}
+	}
+
+	return &dohUpstream{
+		endpoint: u.String(),
+		client:   &http.Client{Transport: transport, Timeout: upstreamTimeout},
+	}, nil
+}
+
+func (u *dohUpstream) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	raw, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequest(http.MethodPost, u.endpoint, bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", dohMediaType)
+	httpReq.Header.Set("Accept", dohMediaType)
+
+	resp, err := u.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh: %s: unexpected status %s", u.endpoint, resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	out := new(dns.Msg)
+	if err := out.Unpack(body); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (u *dohUpstream) String() string { return u.endpoint }
+
+func resolveWithUpstream(u Upstream, host string) (string, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(host), dns.TypeA)
+	resp, err := u.Exchange(m)
+	if err != nil {
+		return "", err
+	}
+	for _, rr := range resp.Answer {
+		if a, ok := rr.(*dns.A); ok {
+			return a.A.String(), nil
+		}
+	}
+	return "", fmt.Errorf("no A record for %s", host)
+}